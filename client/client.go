@@ -0,0 +1,464 @@
+// Package client is the sanctioned way to talk to a socket2em.Server. It
+// speaks the same newline-delimited JSON protocol as the server (and its
+// JSON-RPC 2.0 mode, when enabled), multiplexing concurrent calls over a
+// single connection and reconnecting automatically if it drops.
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sjsafranek/socket2em"
+)
+
+// ErrClosed is returned by any in-flight or future call once Close has been
+// called.
+var ErrClosed = errors.New("socket2em/client: closed")
+
+// Message is a server-pushed (Broadcast) message delivered to a Subscribe
+// channel.
+type Message = socket2em.Message
+
+// Client dials a socket2em.Server and exposes Call/Notify/Subscribe over a
+// single multiplexed connection.
+type Client struct {
+	// Addr is the "host:port" to dial.
+	Addr string
+
+	// EnableJSONRPC must match the server's EnableJSONRPC setting. With it
+	// set, calls are matched to responses by JSON-RPC "id"; without it,
+	// calls are sent one at a time since the legacy protocol has no ids.
+	EnableJSONRPC bool
+
+	// KeepAlive, when true, reconnects automatically in the background
+	// (with exponential backoff) whenever the connection drops. Calls in
+	// flight when it drops still fail with the read error.
+	KeepAlive bool
+
+	// MinBackoff/MaxBackoff bound the reconnect delay. Zero values default
+	// to 100ms and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// MaxFrameSize bounds a single FramingLengthPrefixed payload; see
+	// socket2em.DefaultMaxFrameSize for the fallback when zero.
+	MaxFrameSize int
+
+	// Framing must match the server's Framing setting. FramingNewline
+	// (the default) expects no handshake byte, matching a
+	// default-configured Server; anything else reads one (see getConn).
+	Framing socket2em.FramingMode
+
+	mu            sync.Mutex
+	conn          net.Conn
+	framing       socket2em.FramingMode
+	pending       map[int64]chan socket2em.RPCResponse
+	subscriptions map[string][]chan Message
+	legacyMu      sync.Mutex
+	nextID        int64
+	closed        bool
+	closeCh       chan struct{}
+}
+
+// New creates a Client for addr. Dial (or the first Call/Notify/Subscribe)
+// establishes the connection.
+func New(addr string) *Client {
+	return &Client{
+		Addr:          addr,
+		pending:       make(map[int64]chan socket2em.RPCResponse),
+		subscriptions: make(map[string][]chan Message),
+		closeCh:       make(chan struct{}),
+	}
+}
+
+// Dial connects to Addr and starts the reader goroutine. It is called
+// automatically by Call/Notify/Subscribe if not already connected.
+func (self *Client) Dial(ctx context.Context) error {
+	_, err := self.getConn(ctx)
+	return err
+}
+
+func (self *Client) getConn(ctx context.Context) (net.Conn, error) {
+	self.mu.Lock()
+	if self.closed {
+		self.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if nil != self.conn {
+		conn := self.conn
+		self.mu.Unlock()
+		return conn, nil
+	}
+	self.mu.Unlock()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", self.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Handshake byte: the server (see Server.tcpClientHandler) only sends
+	// this when its Framing opts into something other than the original
+	// protocol, so it's only read here under the same condition - a
+	// default-configured Client talking to a default-configured Server
+	// never touches it.
+	reader := bufio.NewReader(conn)
+	framing := self.Framing
+	if socket2em.FramingNewline != framing {
+		handshake, err := reader.ReadByte()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		framing = socket2em.FramingMode(handshake)
+	}
+
+	self.mu.Lock()
+	self.conn = conn
+	self.framing = framing
+	self.mu.Unlock()
+
+	go self.readLoop(conn, reader, framing)
+	return conn, nil
+}
+
+// readLoop owns conn until it errors out, dispatching each frame either to a
+// pending Call (matched by id) or to Subscribe channels (anything with a
+// method and no id).
+func (self *Client) readLoop(conn net.Conn, reader *bufio.Reader, framing socket2em.FramingMode) {
+	fr := socket2em.NewFrameReader(framing, self.MaxFrameSize, reader)
+	for {
+		frame, err := fr.ReadFrame()
+		if err != nil {
+			self.handleDisconnect(conn, err)
+			return
+		}
+		if 0 == len(frame.Payload) {
+			continue
+		}
+		self.dispatch(frame.Payload)
+	}
+}
+
+// rpcEnvelope is a JSON-RPC 2.0 response or server-pushed notification.
+type rpcEnvelope struct {
+	Method string              `json:"method"`
+	Params json.RawMessage     `json:"params"`
+	Result json.RawMessage     `json:"result"`
+	Error  *socket2em.RPCError `json:"error"`
+	ID     *int64              `json:"id"`
+}
+
+// legacyEnvelope is a reply from Server.HandleSuccess/HandleError
+// ({"status":"ok","data":...} / {"status":"error","error":"<string>"}), or a
+// server-pushed Broadcast message ({"method":...}) with no "status" at all.
+type legacyEnvelope struct {
+	Status string          `json:"status"`
+	Data   json.RawMessage `json:"data"`
+	Error  string          `json:"error"`
+	Method string          `json:"method"`
+}
+
+func (self *Client) dispatch(line []byte) {
+	var ping struct {
+		Method string `json:"method"`
+	}
+	if err := json.Unmarshal(line, &ping); err == nil && "ping" == ping.Method {
+		self.sendPong()
+		return
+	}
+
+	if self.EnableJSONRPC {
+		self.dispatchRPC(line)
+		return
+	}
+	self.dispatchLegacy(line)
+}
+
+func (self *Client) dispatchRPC(line []byte) {
+	var env rpcEnvelope
+	if err := json.Unmarshal(line, &env); err != nil {
+		return
+	}
+
+	if nil != env.ID || nil != env.Error || len(env.Result) > 0 {
+		id := int64(0)
+		if nil != env.ID {
+			id = *env.ID
+		}
+		self.mu.Lock()
+		ch, ok := self.pending[id]
+		if ok {
+			delete(self.pending, id)
+		}
+		self.mu.Unlock()
+		if ok {
+			ch <- socket2em.RPCResponse{Result: env.Result, Error: env.Error}
+		}
+		return
+	}
+
+	if "" == env.Method {
+		return
+	}
+	self.deliverToSubscribers(env.Method, env.Params)
+}
+
+// dispatchLegacy handles the {"status":...}-style protocol: since it never
+// echoes a request id, a reply is always matched to the oldest pending
+// Call (key 0 - see the legacyMu serialization in Call).
+func (self *Client) dispatchLegacy(line []byte) {
+	var env legacyEnvelope
+	if err := json.Unmarshal(line, &env); err != nil {
+		return
+	}
+
+	if "" != env.Status {
+		self.mu.Lock()
+		ch, ok := self.pending[0]
+		if ok {
+			delete(self.pending, 0)
+		}
+		self.mu.Unlock()
+		if !ok {
+			return
+		}
+		if "error" == env.Status {
+			ch <- socket2em.RPCResponse{Error: socket2em.NewRPCError(socket2em.RPCInternalError, env.Error, nil)}
+		} else {
+			ch <- socket2em.RPCResponse{Result: env.Data}
+		}
+		return
+	}
+
+	if "" == env.Method {
+		return
+	}
+	self.deliverToSubscribers(env.Method, env.Data)
+}
+
+func (self *Client) deliverToSubscribers(method string, data json.RawMessage) {
+	self.mu.Lock()
+	subs := append([]chan Message{}, self.subscriptions[method]...)
+	self.mu.Unlock()
+	for _, ch := range subs {
+		select {
+		case ch <- Message{Method: method, Data: data}:
+		default:
+		}
+	}
+}
+
+// sendPong answers a server heartbeat ping so Server.KeepAliveTimeout
+// doesn't disconnect a well-behaved client.
+func (self *Client) sendPong() {
+	self.mu.Lock()
+	conn := self.conn
+	framing := self.framing
+	self.mu.Unlock()
+	if nil == conn {
+		return
+	}
+
+	payload := []byte(`{"method":"pong"}`)
+	if self.EnableJSONRPC {
+		payload = []byte(fmt.Sprintf(`{"jsonrpc":"%v","method":"pong"}`, socket2em.JSONRPCVersion))
+	}
+	conn.Write(socket2em.EncodeFrame(framing, payload))
+}
+
+func (self *Client) handleDisconnect(conn net.Conn, err error) {
+	self.mu.Lock()
+	if self.conn == conn {
+		self.conn = nil
+	}
+	pending := self.pending
+	self.pending = make(map[int64]chan socket2em.RPCResponse)
+	closed := self.closed
+	self.mu.Unlock()
+	conn.Close()
+
+	for _, ch := range pending {
+		ch <- socket2em.RPCResponse{Error: socket2em.NewRPCError(socket2em.RPCInternalError, err.Error(), nil)}
+	}
+
+	if closed || !self.KeepAlive {
+		return
+	}
+	go self.reconnect()
+}
+
+func (self *Client) reconnect() {
+	min := self.MinBackoff
+	if min <= 0 {
+		min = 100 * time.Millisecond
+	}
+	max := self.MaxBackoff
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+
+	backoff := min
+	for {
+		select {
+		case <-self.closeCh:
+			return
+		case <-time.After(backoff):
+		}
+
+		if _, err := self.getConn(context.Background()); err == nil {
+			return
+		}
+
+		backoff *= 2
+		if backoff > max {
+			backoff = max
+		}
+	}
+}
+
+// Call invokes method on the server, waits for the matching response, and
+// decodes its result into out (which may be nil). It honors ctx
+// cancellation.
+func (self *Client) Call(ctx context.Context, method string, params interface{}, out interface{}) error {
+	conn, err := self.getConn(ctx)
+	if err != nil {
+		return err
+	}
+
+	id := atomic.AddInt64(&self.nextID, 1)
+	req, err := self.buildRequest(method, params, &id)
+	if err != nil {
+		return err
+	}
+
+	key := id
+	if !self.EnableJSONRPC {
+		// The legacy protocol doesn't echo request ids back, so only one
+		// call can be in flight at a time; key 0 always means "the next
+		// reply belongs to the oldest pending legacy call".
+		self.legacyMu.Lock()
+		defer self.legacyMu.Unlock()
+		key = 0
+	}
+
+	ch := make(chan socket2em.RPCResponse, 1)
+	self.mu.Lock()
+	self.pending[key] = ch
+	self.mu.Unlock()
+
+	if _, err := conn.Write(req); err != nil {
+		self.mu.Lock()
+		delete(self.pending, key)
+		self.mu.Unlock()
+		return err
+	}
+
+	select {
+	case resp := <-ch:
+		if nil != resp.Error {
+			return resp.Error
+		}
+		if nil != out {
+			if raw, ok := resp.Result.(json.RawMessage); ok && len(raw) > 0 {
+				return json.Unmarshal(raw, out)
+			}
+		}
+		return nil
+	case <-self.closeCh:
+		return ErrClosed
+	case <-ctx.Done():
+		self.mu.Lock()
+		delete(self.pending, key)
+		self.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Notify sends method as a one-way notification; it never waits for (or
+// expects) a reply.
+func (self *Client) Notify(method string, params interface{}) error {
+	conn, err := self.getConn(context.Background())
+	if err != nil {
+		return err
+	}
+	req, err := self.buildRequest(method, params, nil)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(req)
+	return err
+}
+
+func (self *Client) buildRequest(method string, params interface{}, id *int64) ([]byte, error) {
+	if self.EnableJSONRPC {
+		raw, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		var rpcID interface{}
+		if nil != id {
+			rpcID = *id
+		}
+		req := socket2em.RPCRequest{JSONRPC: socket2em.JSONRPCVersion, Method: method, Params: raw, ID: rpcID}
+		js, err := json.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		return socket2em.EncodeFrame(self.framing, js), nil
+	}
+
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	js, err := json.Marshal(socket2em.Message{Method: method, Data: raw})
+	if err != nil {
+		return nil, err
+	}
+	return socket2em.EncodeFrame(self.framing, js), nil
+}
+
+// Subscribe returns a channel of every Broadcast message whose method
+// matches. The channel is buffered (size 8, best-effort): a slow
+// subscriber drops messages rather than blocking the reader goroutine.
+func (self *Client) Subscribe(method string) (<-chan Message, error) {
+	if _, err := self.getConn(context.Background()); err != nil {
+		return nil, err
+	}
+	ch := make(chan Message, 8)
+	self.mu.Lock()
+	self.subscriptions[method] = append(self.subscriptions[method], ch)
+	self.mu.Unlock()
+	return ch, nil
+}
+
+// Close tears down the connection and fails every pending Call with
+// ErrClosed. It is safe to call more than once.
+func (self *Client) Close() error {
+	self.mu.Lock()
+	if self.closed {
+		self.mu.Unlock()
+		return nil
+	}
+	self.closed = true
+	conn := self.conn
+	self.conn = nil
+	// Pending calls are dropped rather than answered: each waiting Call
+	// sees closeCh close and returns ErrClosed.
+	self.pending = make(map[int64]chan socket2em.RPCResponse)
+	self.mu.Unlock()
+
+	close(self.closeCh)
+	if nil != conn {
+		return conn.Close()
+	}
+	return nil
+}
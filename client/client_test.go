@@ -0,0 +1,153 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sjsafranek/socket2em"
+	"github.com/sjsafranek/socket2em/client"
+)
+
+func waitForListener(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server on %s never came up", addr)
+}
+
+// dialWithRetry retries Dial until it succeeds, for a server that's still
+// coming up. Using c.Dial itself (rather than a throwaway probe connection)
+// avoids tripping the server's own OnDisconnect for an unrelated connection.
+func dialWithRetry(t *testing.T, c *client.Client) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	var err error
+	for time.Now().Before(deadline) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		err = c.Dial(ctx)
+		cancel()
+		if err == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Dial never succeeded: %v", err)
+}
+
+func stopServer(t *testing.T, srv *socket2em.Server) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	srv.Stop(ctx)
+}
+
+// TestCallLegacyRoundTrip exercises the legacy {"status":...}-reply protocol
+// end to end; it would hang until ctx expires if dispatchLegacy didn't
+// understand the server's real reply shape.
+func TestCallLegacyRoundTrip(t *testing.T) {
+	addr := "127.0.0.1:19401"
+	srv := &socket2em.Server{Host: "127.0.0.1", Port: 19401}
+	srv.RegisterMethod("echo", func(msg socket2em.Message, conn net.Conn) {
+		var args struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(msg.Data, &args)
+		srv.SendResponseFromStruct(args.Message, conn)
+	})
+	go srv.Start()
+	defer stopServer(t, srv)
+	waitForListener(t, addr)
+
+	c := client.New(addr)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var out string
+	if err := c.Call(ctx, "echo", map[string]string{"message": "hi"}, &out); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if "hi" != out {
+		t.Fatalf("got %q, want %q", out, "hi")
+	}
+}
+
+// TestCallJSONRPCLengthPrefixedRoundTrip exercises the JSON-RPC 2.0 dispatcher
+// over length-prefixed framing.
+func TestCallJSONRPCLengthPrefixedRoundTrip(t *testing.T) {
+	addr := "127.0.0.1:19402"
+	srv := &socket2em.Server{
+		Host:          "127.0.0.1",
+		Port:          19402,
+		EnableJSONRPC: true,
+		Framing:       socket2em.FramingLengthPrefixed,
+	}
+	srv.RegisterRPC("echo", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		var args struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(params, &args)
+		return args.Message, nil
+	})
+	go srv.Start()
+	defer stopServer(t, srv)
+	waitForListener(t, addr)
+
+	c := client.New(addr)
+	c.EnableJSONRPC = true
+	c.Framing = socket2em.FramingLengthPrefixed
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var out string
+	if err := c.Call(ctx, "echo", map[string]string{"message": "hi"}, &out); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if "hi" != out {
+		t.Fatalf("got %q, want %q", out, "hi")
+	}
+}
+
+// TestKeepAliveAnswersPing checks that a Client left idle after Dial answers
+// the server's pings, so it isn't disconnected as a stale connection.
+func TestKeepAliveAnswersPing(t *testing.T) {
+	addr := "127.0.0.1:19403"
+	disconnected := make(chan struct{}, 1)
+	srv := &socket2em.Server{
+		Host:              "127.0.0.1",
+		Port:              19403,
+		KeepAliveInterval: 80 * time.Millisecond,
+		KeepAliveTimeout:  80 * time.Millisecond,
+		OnDisconnect: func(string) {
+			select {
+			case disconnected <- struct{}{}:
+			default:
+			}
+		},
+	}
+	go srv.Start()
+	defer stopServer(t, srv)
+
+	c := client.New(addr)
+	defer c.Close()
+	dialWithRetry(t, c)
+
+	select {
+	case <-disconnected:
+		t.Fatal("client was disconnected despite answering keepalive pings")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
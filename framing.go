@@ -0,0 +1,110 @@
+package socket2em
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/textproto"
+)
+
+// FramingMode selects how tcpClientHandler splits a connection's byte
+// stream into individual messages.
+type FramingMode int
+
+const (
+	// FramingNewline (the default) is the original protocol: one message
+	// per newline-terminated line, via textproto.Reader.
+	FramingNewline FramingMode = iota
+
+	// FramingLengthPrefixed frames each message as a 4-byte big-endian
+	// length followed by that many bytes of payload, so a payload may
+	// contain raw newlines or non-JSON binary data.
+	FramingLengthPrefixed
+)
+
+// DefaultMaxFrameSize bounds a single FramingLengthPrefixed payload when
+// Server.MaxFrameSize is left at zero.
+const DefaultMaxFrameSize = 1 << 20 // 1 MiB
+
+// Frame is a single decoded message, independent of which FramingMode
+// produced it.
+type Frame struct {
+	Payload []byte
+}
+
+// FrameReader reads successive Frames off a connection; newlineFrameReader
+// and lengthPrefixedFrameReader are its two implementations, letting callers
+// stay agnostic of which FramingMode is in effect. The client package reuses
+// it after negotiating a FramingMode over the handshake byte.
+type FrameReader interface {
+	ReadFrame() (Frame, error)
+}
+
+// NewFrameReader builds the FrameReader for mode, reading from reader.
+// maxFrameSize (FramingLengthPrefixed only) falls back to
+// DefaultMaxFrameSize when zero.
+func NewFrameReader(mode FramingMode, maxFrameSize int, reader *bufio.Reader) FrameReader {
+	if FramingLengthPrefixed == mode {
+		return &lengthPrefixedFrameReader{r: reader, maxFrameSize: maxFrameSize}
+	}
+	return &newlineFrameReader{tp: textproto.NewReader(reader)}
+}
+
+// EncodeFrame serializes payload for mode: a trailing newline for
+// FramingNewline, or a 4-byte big-endian length prefix for
+// FramingLengthPrefixed.
+func EncodeFrame(mode FramingMode, payload []byte) []byte {
+	if FramingLengthPrefixed != mode {
+		return append(payload, '\n')
+	}
+	framed := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(framed, uint32(len(payload)))
+	copy(framed[4:], payload)
+	return framed
+}
+
+type newlineFrameReader struct {
+	tp *textproto.Reader
+}
+
+func (self *newlineFrameReader) ReadFrame() (Frame, error) {
+	line, err := self.tp.ReadLine()
+	if err != nil {
+		return Frame{}, err
+	}
+	return Frame{Payload: []byte(line)}, nil
+}
+
+type lengthPrefixedFrameReader struct {
+	r            *bufio.Reader
+	maxFrameSize int
+}
+
+func (self *lengthPrefixedFrameReader) ReadFrame() (Frame, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(self.r, header[:]); err != nil {
+		if io.ErrUnexpectedEOF == err {
+			return Frame{}, io.EOF
+		}
+		return Frame{}, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	maxFrameSize := self.maxFrameSize
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	if int(size) > maxFrameSize {
+		return Frame{}, fmt.Errorf("frame of %d bytes exceeds MaxFrameSize of %d", size, maxFrameSize)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(self.r, payload); err != nil {
+		if io.ErrUnexpectedEOF == err {
+			return Frame{}, io.EOF
+		}
+		return Frame{}, err
+	}
+	return Frame{Payload: payload}, nil
+}
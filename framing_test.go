@@ -0,0 +1,45 @@
+package socket2em
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestEncodeFrameNewlineRoundTrip(t *testing.T) {
+	payload := []byte(`{"hello":"world"}`)
+	encoded := EncodeFrame(FramingNewline, append([]byte{}, payload...))
+
+	reader := NewFrameReader(FramingNewline, 0, bufio.NewReader(bytes.NewReader(encoded)))
+	frame, err := reader.ReadFrame()
+	if err != nil {
+		t.Fatalf("ReadFrame: %v", err)
+	}
+	if string(frame.Payload) != string(payload) {
+		t.Fatalf("got payload %q, want %q", frame.Payload, payload)
+	}
+}
+
+func TestEncodeFrameLengthPrefixedRoundTrip(t *testing.T) {
+	payload := []byte(`{"hello":"world"}`)
+	encoded := EncodeFrame(FramingLengthPrefixed, append([]byte{}, payload...))
+
+	reader := NewFrameReader(FramingLengthPrefixed, 0, bufio.NewReader(bytes.NewReader(encoded)))
+	frame, err := reader.ReadFrame()
+	if err != nil {
+		t.Fatalf("ReadFrame: %v", err)
+	}
+	if string(frame.Payload) != string(payload) {
+		t.Fatalf("got payload %q, want %q", frame.Payload, payload)
+	}
+}
+
+func TestLengthPrefixedFrameReaderRejectsOversizeFrame(t *testing.T) {
+	payload := make([]byte, 10)
+	encoded := EncodeFrame(FramingLengthPrefixed, payload)
+
+	reader := NewFrameReader(FramingLengthPrefixed, 4, bufio.NewReader(bytes.NewReader(encoded)))
+	if _, err := reader.ReadFrame(); err == nil {
+		t.Fatal("expected an oversize frame to be rejected")
+	}
+}
@@ -0,0 +1,203 @@
+package socket2em
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// JSONRPCVersion is the only protocol version this package understands.
+const JSONRPCVersion = "2.0"
+
+// Reserved JSON-RPC 2.0 error codes. Handlers registered with RegisterRPC
+// may return a *RPCError using any code in the -32000..-32099 server-error
+// range; the rest are produced internally by the dispatcher.
+const (
+	RPCParseError     = -32700
+	RPCInvalidRequest = -32600
+	RPCMethodNotFound = -32601
+	RPCInvalidParams  = -32602
+	RPCInternalError  = -32603
+	RPCServerErrorMin = -32099
+	RPCServerErrorMax = -32000
+)
+
+// RPCError is the standard JSON-RPC 2.0 error object.
+type RPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (self *RPCError) Error() string {
+	return self.Message
+}
+
+// NewRPCError builds an *RPCError, useful for handlers that want to return
+// a server-defined error code in the -32000..-32099 range.
+func NewRPCError(code int, message string, data interface{}) *RPCError {
+	return &RPCError{Code: code, Message: message, Data: data}
+}
+
+// RPCRequest is a single JSON-RPC 2.0 request or notification. Params may be
+// either a positional array or a named object; handlers decode it themselves.
+type RPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      interface{}     `json:"id,omitempty"`
+}
+
+func (self *RPCRequest) isNotification() bool {
+	return self.ID == nil
+}
+
+// RPCResponse is a single JSON-RPC 2.0 response. Result and Error are
+// mutually exclusive.
+type RPCResponse struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Result  interface{} `json:"result,omitempty"`
+	Error   *RPCError   `json:"error,omitempty"`
+	ID      interface{} `json:"id"`
+}
+
+// RPCHandlerFunc handles a single JSON-RPC method call. Returning an
+// *RPCError lets a handler control the code/data sent back to the client;
+// any other error is reported as RPCInternalError.
+type RPCHandlerFunc func(ctx context.Context, params json.RawMessage) (interface{}, error)
+
+// RegisterRPC registers a handler for the JSON-RPC 2.0 dispatcher. It only
+// takes effect once Server.EnableJSONRPC is set; RegisterMethod continues to
+// work unchanged for servers that don't opt in.
+func (self *Server) RegisterRPC(method string, function RPCHandlerFunc) error {
+	self.init()
+	if "rpc." == method[:minInt(4, len(method))] {
+		return fmt.Errorf("Method not allowed")
+	}
+	self.RPCHandlers[method] = function
+	return nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// handleJSONRPC parses a single line of input as either a JSON-RPC request
+// object or a batch (array) of them, dispatches each, and writes back the
+// matching response(s). Notifications (requests with no "id") never produce
+// a reply; an all-notification batch produces no reply at all.
+func (self *Server) handleJSONRPC(raw []byte, conn net.Conn) {
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) == 0 {
+		return
+	}
+
+	if trimmed[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(trimmed, &batch); err != nil || len(batch) == 0 {
+			self.writeRPC(conn, &RPCResponse{JSONRPC: JSONRPCVersion, Error: NewRPCError(RPCInvalidRequest, "Invalid Request", nil), ID: nil})
+			return
+		}
+		responses := make([]*RPCResponse, 0, len(batch))
+		for _, item := range batch {
+			if resp := self.dispatchRPC(item, conn); resp != nil {
+				responses = append(responses, resp)
+			}
+		}
+		if len(responses) == 0 {
+			return
+		}
+		self.writeRPC(conn, responses)
+		return
+	}
+
+	if resp := self.dispatchRPC(trimmed, conn); resp != nil {
+		self.writeRPC(conn, resp)
+	}
+}
+
+func (self *Server) dispatchRPC(raw json.RawMessage, conn net.Conn) *RPCResponse {
+	var req RPCRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return &RPCResponse{JSONRPC: JSONRPCVersion, Error: NewRPCError(RPCParseError, "Parse error", nil), ID: nil}
+	}
+	if req.JSONRPC != JSONRPCVersion || req.Method == "" {
+		return &RPCResponse{JSONRPC: JSONRPCVersion, Error: NewRPCError(RPCInvalidRequest, "Invalid Request", nil), ID: req.ID}
+	}
+
+	if "auth" == req.Method && nil != self.AuthTokenValidator {
+		return self.handleAuthRPC(req, conn)
+	}
+
+	function, ok := self.RPCHandlers[req.Method]
+	if !ok {
+		if req.isNotification() {
+			return nil
+		}
+		return &RPCResponse{JSONRPC: JSONRPCVersion, Error: NewRPCError(RPCMethodNotFound, "Method not found", nil), ID: req.ID}
+	}
+
+	// Run the handler through the same middleware chain Use() installs for
+	// RegisterMethod handlers, so TokenAuthMiddleware/RateLimitMiddleware
+	// apply here too.
+	var result interface{}
+	handler := self.chain(func(m Message, c net.Conn) error {
+		r, err := function(context.Background(), m.Data)
+		result = r
+		return err
+	})
+	err := handler(Message{Method: req.Method, Data: req.Params}, conn)
+
+	if req.isNotification() {
+		if err != nil {
+			self.Log(conn.RemoteAddr().String(), err.Error())
+		}
+		return nil
+	}
+	if err != nil {
+		if rpcErr, ok := err.(*RPCError); ok {
+			return &RPCResponse{JSONRPC: JSONRPCVersion, Error: rpcErr, ID: req.ID}
+		}
+		return &RPCResponse{JSONRPC: JSONRPCVersion, Error: NewRPCError(RPCInternalError, err.Error(), nil), ID: req.ID}
+	}
+	return &RPCResponse{JSONRPC: JSONRPCVersion, Result: result, ID: req.ID}
+}
+
+// handleAuthRPC is the JSON-RPC counterpart of Server.handleAuth: it answers
+// the {"method":"auth","params":{"token":"..."}} handshake so TokenAuthMiddleware
+// has something to unlock when EnableJSONRPC is set.
+func (self *Server) handleAuthRPC(req RPCRequest, conn net.Conn) *RPCResponse {
+	var params struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal(req.Params, &params)
+
+	ok := self.AuthTokenValidator(params.Token)
+	self.ClientState(conn).Authenticated = ok
+
+	if req.isNotification() {
+		return nil
+	}
+	if !ok {
+		return &RPCResponse{JSONRPC: JSONRPCVersion, Error: NewRPCError(RPCInvalidParams, "Invalid token", nil), ID: req.ID}
+	}
+	return &RPCResponse{JSONRPC: JSONRPCVersion, Result: map[string]bool{"authenticated": true}, ID: req.ID}
+}
+
+func (self *Server) writeRPC(conn net.Conn, payload interface{}) {
+	js, err := json.Marshal(payload)
+	if err != nil {
+		self.Log(conn.RemoteAddr().String(), err.Error())
+		return
+	}
+	if self.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(self.WriteTimeout))
+	}
+	conn.Write(EncodeFrame(self.Framing, js))
+}
@@ -0,0 +1,97 @@
+package socket2em
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// isPong reports whether message is a keepalive reply, in either the legacy
+// or JSON-RPC wire format. It tolerates anything with a top-level "method"
+// field so it works regardless of which protocol is enabled.
+func (self *Server) isPong(message string) bool {
+	var probe struct {
+		Method string `json:"method"`
+	}
+	if err := json.Unmarshal([]byte(message), &probe); err != nil {
+		return false
+	}
+	return "pong" == probe.Method
+}
+
+// signalPong wakes up the keepalive goroutine for idx, if one is waiting.
+func (self *Server) signalPong(idx int) {
+	self.guard.RLock()
+	ch, ok := self.pongSignals[idx]
+	self.guard.RUnlock()
+	if !ok {
+		return
+	}
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (self *Server) sendPing(conn net.Conn) {
+	if self.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(self.WriteTimeout))
+	}
+	payload := []byte(`{"method":"ping"}`)
+	if self.EnableJSONRPC {
+		payload = []byte(fmt.Sprintf(`{"jsonrpc":"%v","method":"ping"}`, JSONRPCVersion))
+	}
+	conn.Write(EncodeFrame(self.Framing, payload))
+}
+
+// keepAlive runs for the life of a connection, pinging it every
+// KeepAliveInterval and expecting a pong within KeepAliveTimeout. A missed
+// pong closes the connection and fires OnPingTimeout. It is a no-op unless
+// KeepAliveInterval is set.
+func (self *Server) keepAlive(ctx context.Context, conn net.Conn, pong <-chan struct{}) {
+	if self.KeepAliveInterval <= 0 {
+		return
+	}
+	timeout := self.KeepAliveTimeout
+	if timeout <= 0 {
+		timeout = self.KeepAliveInterval
+	}
+
+	ticker := time.NewTicker(self.KeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			self.sendPing(conn)
+			select {
+			case <-pong:
+				// client is alive
+			case <-time.After(timeout):
+				self.Log(conn.RemoteAddr().String(), "Ping timeout")
+				if nil != self.OnPingTimeout {
+					self.OnPingTimeout(conn.RemoteAddr().String())
+				}
+				conn.Close()
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// dropClient closes conn and removes it from Clients without touching
+// NumClients/the wait group/the accept token; the owning tcpClientHandler
+// notices the closed connection on its next read and runs closeClient
+// itself, so bookkeeping only happens once.
+func (self *Server) dropClient(idx int, conn net.Conn) {
+	conn.Close()
+	self.guard.Lock()
+	delete(self.Clients, idx)
+	self.guard.Unlock()
+}
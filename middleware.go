@@ -0,0 +1,129 @@
+package socket2em
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Handler is a single dispatch step: given the decoded message and the
+// connection it arrived on, it either hands off to the next step or returns
+// an error that gets reported back to the client via HandleError (or, with
+// EnableJSONRPC set, as a JSON-RPC error object).
+type Handler func(Message, net.Conn) error
+
+// Use appends a middleware to the chain wrapped around every registered
+// method in tcpClientHandler. Middlewares run in the order they were added,
+// outermost first.
+func (self *Server) Use(mw func(Handler) Handler) {
+	self.init()
+	self.middlewares = append(self.middlewares, mw)
+}
+
+// chain wraps final with every registered middleware.
+func (self *Server) chain(final Handler) Handler {
+	h := final
+	for i := len(self.middlewares) - 1; i >= 0; i-- {
+		h = self.middlewares[i](h)
+	}
+	return h
+}
+
+// ClientState holds per-connection state - auth status, rate-limit
+// bookkeeping, or anything a middleware wants to stash - keyed by client
+// index so it survives across messages on the same connection.
+type ClientState struct {
+	Authenticated bool
+	Data          map[string]interface{}
+
+	mu          sync.Mutex
+	windowStart time.Time
+	count       int
+}
+
+// idxFor looks up the Clients index backing conn, if any.
+func (self *Server) idxFor(conn net.Conn) (int, bool) {
+	self.guard.RLock()
+	defer self.guard.RUnlock()
+	for idx, c := range self.Clients {
+		if c == conn {
+			return idx, true
+		}
+	}
+	return 0, false
+}
+
+func (self *Server) stateFor(idx int) *ClientState {
+	actual, _ := self.clientState.LoadOrStore(idx, &ClientState{Data: make(map[string]interface{})})
+	return actual.(*ClientState)
+}
+
+// ClientState returns the per-connection state for conn, creating it if this
+// is the first time it's been asked for.
+func (self *Server) ClientState(conn net.Conn) *ClientState {
+	idx, ok := self.idxFor(conn)
+	if !ok {
+		return &ClientState{Data: make(map[string]interface{})}
+	}
+	return self.stateFor(idx)
+}
+
+// handleAuth answers the {"method":"auth","data":{"token":"..."}} handshake
+// by running AuthTokenValidator and recording the result on the
+// connection's ClientState.
+func (self *Server) handleAuth(req Message, conn net.Conn) {
+	var params struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal(req.Data, &params)
+
+	ok := self.AuthTokenValidator(params.Token)
+	self.ClientState(conn).Authenticated = ok
+
+	if !ok {
+		self.HandleError(fmt.Errorf("Invalid token"), conn)
+		return
+	}
+	self.HandleSuccess(`{"authenticated":true}`, conn)
+}
+
+// TokenAuthMiddleware rejects any call from a connection that hasn't
+// completed the {"method":"auth","data":{"token":"..."}} handshake handled
+// in tcpClientHandler (which sets ClientState.Authenticated).
+func (self *Server) TokenAuthMiddleware() func(Handler) Handler {
+	return func(next Handler) Handler {
+		return func(msg Message, conn net.Conn) error {
+			if !self.ClientState(conn).Authenticated {
+				return fmt.Errorf("Not authenticated")
+			}
+			return next(msg, conn)
+		}
+	}
+}
+
+// RateLimitMiddleware allows at most limit calls per window for each
+// connection, tracked independently per client index.
+func (self *Server) RateLimitMiddleware(limit int, window time.Duration) func(Handler) Handler {
+	return func(next Handler) Handler {
+		return func(msg Message, conn net.Conn) error {
+			state := self.ClientState(conn)
+
+			state.mu.Lock()
+			now := time.Now()
+			if now.Sub(state.windowStart) > window {
+				state.windowStart = now
+				state.count = 0
+			}
+			state.count++
+			exceeded := state.count > limit
+			state.mu.Unlock()
+
+			if exceeded {
+				return fmt.Errorf("Rate limit exceeded")
+			}
+			return next(msg, conn)
+		}
+	}
+}
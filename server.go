@@ -2,27 +2,81 @@ package socket2em
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"net/textproto"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Server struct {
 	Host           string
 	Port           int
 	ConnType       string
-	NumClients     int
+	NumClients     int64
 	LoggingHandler func(string)
 	OnDisconnect   func(string)
 	MethodHandlers map[string]func(Message, net.Conn)
 	Clients        map[int]net.Conn
 	guard          sync.RWMutex
+
+	// EnableJSONRPC switches the dispatcher in tcpClientHandler over to the
+	// JSON-RPC 2.0 protocol (see jsonrpc.go). Methods registered with
+	// RegisterMethod are ignored while this is set; existing servers that
+	// leave it false are unaffected.
+	EnableJSONRPC bool
+	RPCHandlers   map[string]RPCHandlerFunc
+
+	// MaxClients caps the number of concurrently accepted connections. Zero
+	// (the default) means unbounded, matching the previous behavior.
+	MaxClients int
+
+	// ReadTimeout/WriteTimeout, when non-zero, are applied to each
+	// connection before every read/write so a slow or dead peer can't pin
+	// its handler goroutine forever.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// KeepAliveInterval/KeepAliveTimeout enable an application-level
+	// heartbeat: every KeepAliveInterval each client is sent a ping and
+	// must reply with a pong within KeepAliveTimeout (defaulting to
+	// KeepAliveInterval) or it is disconnected. Zero KeepAliveInterval (the
+	// default) disables the heartbeat entirely.
+	KeepAliveInterval time.Duration
+	KeepAliveTimeout  time.Duration
+	OnPingTimeout     func(string)
+
+	// TLSConfig, when non-nil, makes Start listen for TLS connections
+	// instead of plaintext ones.
+	TLSConfig *tls.Config
+
+	// AuthTokenValidator, when set, makes tcpClientHandler honor an
+	// {"method":"auth","data":{"token":"..."}} handshake: the token is
+	// passed to AuthTokenValidator and the result stored on the
+	// connection's ClientState for TokenAuthMiddleware to check.
+	AuthTokenValidator func(token string) bool
+
+	// Framing selects how messages are delimited on the wire; see
+	// FramingMode. MaxFrameSize bounds a single FramingLengthPrefixed
+	// payload, defaulting to DefaultMaxFrameSize when zero.
+	Framing      FramingMode
+	MaxFrameSize int
+
+	listener    net.Listener
+	accept      chan struct{}
+	wg          sync.WaitGroup
+	ctx         context.Context
+	cancel      context.CancelFunc
+	pongSignals map[int]chan struct{}
+	middlewares []func(Handler) Handler
+	clientState sync.Map
 }
 
 func (self *Server) RegisterMethod(method string, function func(Message, net.Conn)) error {
@@ -75,6 +129,21 @@ func (self *Server) init() {
 	if nil == self.Clients {
 		self.Clients = make(map[int]net.Conn)
 	}
+	if nil == self.RPCHandlers {
+		self.RPCHandlers = make(map[string]RPCHandlerFunc)
+	}
+	if nil == self.pongSignals {
+		self.pongSignals = make(map[int]chan struct{})
+	}
+	if nil == self.ctx {
+		self.ctx, self.cancel = context.WithCancel(context.Background())
+	}
+	if nil == self.accept && self.MaxClients > 0 {
+		self.accept = make(chan struct{}, self.MaxClients)
+		for i := 0; i < self.MaxClients; i++ {
+			self.accept <- struct{}{}
+		}
+	}
 }
 
 func (self *Server) Start() {
@@ -83,25 +152,48 @@ func (self *Server) Start() {
 
 	counter := 0
 
-	self.NumClients = 0
+	atomic.StoreInt64(&self.NumClients, 0)
 
 	// Check settings and apply defaults
 	serv := fmt.Sprintf("%v:%v", self.getHost(), self.getPort())
 
 	// Listen for incoming connections.
-	l, err := net.Listen(self.getConnType(), serv)
+	var l net.Listener
+	var err error
+	if nil != self.TLSConfig {
+		l, err = tls.Listen(self.getConnType(), serv, self.TLSConfig)
+	} else {
+		l, err = net.Listen(self.getConnType(), serv)
+	}
 	if err != nil {
 		self.Log("Error listening:", err.Error())
 		panic(err)
 	}
+	self.listener = l
 	self.Log("Tcp Listening on " + serv)
 
 	// Close the listener when the application closes.
 	defer l.Close()
 	for {
+		// Apply backpressure: block for an accept token before taking the
+		// next connection so we never run more than MaxClients handlers.
+		if nil != self.accept {
+			select {
+			case <-self.accept:
+			case <-self.ctx.Done():
+				return
+			}
+		}
+
 		// Listen for an incoming connection.
 		conn, err := l.Accept()
 		if err != nil {
+			select {
+			case <-self.ctx.Done():
+				self.Log("Tcp Listener stopped")
+				return
+			default:
+			}
 			self.Log("Error accepting connection: ", err.Error())
 			return
 		}
@@ -114,49 +206,140 @@ func (self *Server) Start() {
 		self.guard.Unlock()
 
 		// Handle connections in a new goroutine.
-		go self.tcpClientHandler(conn, counter)
+		self.wg.Add(1)
+		go self.tcpClientHandler(self.ctx, conn, counter)
 
 	}
 }
 
+// Stop gracefully shuts the server down: it stops accepting new clients,
+// broadcasts a shutdown notice, and waits for in-flight handlers to return.
+// If ctx expires first, any stragglers are force-closed.
+func (self *Server) Stop(ctx context.Context) error {
+	self.init()
+
+	// Broadcast before cancelling: cancellation closes every connection.
+	self.Broadcast(`{"method":"shutdown"}`)
+	self.cancel()
+	if nil != self.listener {
+		self.listener.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		self.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		self.guard.Lock()
+		for _, conn := range self.Clients {
+			conn.Close()
+		}
+		self.guard.Unlock()
+		return ctx.Err()
+	}
+}
+
 func (self *Server) GetNumClients() int {
-	return self.NumClients
+	return int(atomic.LoadInt64(&self.NumClients))
 }
 
 // close tcp client
 func (self *Server) closeClient(conn net.Conn, idx int) {
-	self.NumClients--
+	atomic.AddInt64(&self.NumClients, -1)
 	conn.Close()
 	self.guard.Lock()
 	delete(self.Clients, idx)
 	self.guard.Unlock()
+	if nil != self.accept {
+		self.accept <- struct{}{}
+	}
+	self.clientState.Delete(idx)
+	self.wg.Done()
 	if nil != self.OnDisconnect {
 		self.OnDisconnect(conn.RemoteAddr().String())
 	}
 }
 
 // Handles incoming requests.
-func (self *Server) tcpClientHandler(conn net.Conn, idx int) {
+func (self *Server) tcpClientHandler(ctx context.Context, conn net.Conn, idx int) {
+
+	// Derived from the server's context so Stop cancels it too, but
+	// cancelled on our own return so the watcher goroutine below (and
+	// keepAlive) are reclaimed as soon as this connection closes, not just
+	// at shutdown.
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	self.NumClients++
+	atomic.AddInt64(&self.NumClients, 1)
 	defer self.closeClient(conn, idx)
 
+	go func() {
+		<-connCtx.Done()
+		conn.Close()
+	}()
+
+	pong := make(chan struct{}, 1)
+	self.guard.Lock()
+	self.pongSignals[idx] = pong
+	self.guard.Unlock()
+	defer func() {
+		self.guard.Lock()
+		delete(self.pongSignals, idx)
+		self.guard.Unlock()
+	}()
+	go self.keepAlive(connCtx, conn, pong)
+
+	// Handshake byte: tells the client (see client.Dial) which FramingMode
+	// to use for the rest of the connection. Only sent when Framing opts
+	// into something other than the original protocol, so a default-
+	// configured Server (and every pre-existing newline-JSON consumer)
+	// sees byte-for-byte the same wire output as before this field
+	// existed.
+	if FramingNewline != self.Framing {
+		conn.Write([]byte{byte(self.Framing)})
+	}
+
 	reader := bufio.NewReader(conn)
-	tp := textproto.NewReader(reader)
+	fr := NewFrameReader(self.Framing, self.MaxFrameSize, reader)
 
 	for {
-		// will listen for message to process ending in newline (\n)
-		message, err := tp.ReadLine()
+		if self.ReadTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(self.ReadTimeout))
+		}
+
+		// will listen for the next frame (a line, or a length-prefixed
+		// payload, depending on self.Framing)
+		frame, err := fr.ReadFrame()
 		if io.EOF == err {
 			self.Log(conn.RemoteAddr().String(), "Connection closed")
 			return
 		}
+		if err != nil {
+			self.Log(conn.RemoteAddr().String(), err.Error())
+			return
+		}
+		message := string(frame.Payload)
 
 		// No message was sent
 		if "" == message {
 			continue
 		}
 
+		if self.isPong(message) {
+			self.signalPong(idx)
+			continue
+		}
+
+		if self.EnableJSONRPC {
+			self.handleJSONRPC([]byte(message), conn)
+			continue
+		}
+
 		// Command
 		exitFlag := false
 		switch {
@@ -187,7 +370,10 @@ func (self *Server) tcpClientHandler(conn net.Conn, idx int) {
 			// '\x04' end of transmittion character
 			self.Log(conn.RemoteAddr().String(), err.Error())
 			resp := `{"status": "error", "error": "` + fmt.Sprintf("%v", err) + `",""}`
-			conn.Write([]byte(resp + "\n"))
+			if self.WriteTimeout > 0 {
+				conn.SetWriteDeadline(time.Now().Add(self.WriteTimeout))
+			}
+			conn.Write(EncodeFrame(self.Framing, []byte(resp)))
 			continue
 		}
 
@@ -199,10 +385,18 @@ func (self *Server) tcpClientHandler(conn net.Conn, idx int) {
 			// {"method": "help"}
 			response := self.Help()
 			self.HandleSuccess(response, conn)
+		case req.Method == "auth" && nil != self.AuthTokenValidator:
+			self.handleAuth(req, conn)
 		default:
-			// Run registered method
+			// Run registered method, wrapped in any middleware installed via Use.
 			if function, ok := self.MethodHandlers[req.Method]; ok {
-				function(req, conn)
+				handler := self.chain(func(m Message, c net.Conn) error {
+					function(m, c)
+					return nil
+				})
+				if err := handler(req, conn); err != nil {
+					self.HandleError(err, conn)
+				}
 			} else {
 				err := errors.New("Method not found")
 				self.HandleError(err, conn)
@@ -221,11 +415,17 @@ func (self *Server) Help() string {
 }
 
 func (self Server) HandleError(err error, conn net.Conn) {
-	conn.Write([]byte("{\"status\": \"error\", \"error\": \"" + err.Error() + "\"}\n"))
+	if self.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(self.WriteTimeout))
+	}
+	conn.Write(EncodeFrame(self.Framing, []byte("{\"status\": \"error\", \"error\": \""+err.Error()+"\"}")))
 }
 
 func (self Server) HandleSuccess(data string, conn net.Conn) {
-	conn.Write([]byte("{\"status\": \"ok\", \"data\": " + data + "}\n"))
+	if self.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(self.WriteTimeout))
+	}
+	conn.Write(EncodeFrame(self.Framing, []byte("{\"status\": \"ok\", \"data\": "+data+"}")))
 }
 
 func (self Server) missingParams(conn net.Conn) {
@@ -243,7 +443,19 @@ func (self Server) SendResponseFromStruct(data interface{}, conn net.Conn) {
 }
 
 func (self *Server) Broadcast(message string) {
-	for _, conn := range self.Clients {
-		conn.Write([]byte(fmt.Sprintf("%v\n", message)))
+	self.guard.RLock()
+	recipients := make(map[int]net.Conn, len(self.Clients))
+	for idx, conn := range self.Clients {
+		recipients[idx] = conn
+	}
+	self.guard.RUnlock()
+
+	for idx, conn := range recipients {
+		if self.WriteTimeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(self.WriteTimeout))
+		}
+		if _, err := conn.Write(EncodeFrame(self.Framing, []byte(message))); err != nil {
+			self.dropClient(idx, conn)
+		}
 	}
 }
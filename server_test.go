@@ -0,0 +1,60 @@
+package socket2em
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestDefaultFramingOmitsHandshakeByte pins down the original newline-JSON
+// protocol: a default-configured Server (Framing left at FramingNewline)
+// must not prepend a handshake byte, so a plain net.Dial consumer that
+// predates the framing/client packages can still parse every reply.
+func TestDefaultFramingOmitsHandshakeByte(t *testing.T) {
+	addr := "127.0.0.1:19501"
+	srv := &Server{Host: "127.0.0.1", Port: 19501}
+	srv.RegisterMethod("echo", func(msg Message, conn net.Conn) {
+		srv.HandleSuccess(string(msg.Data), conn)
+	})
+	go srv.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Stop(ctx)
+	}()
+
+	conn := dialWithRetry(t, addr)
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("{\"method\": \"echo\", \"data\": {\"message\": \"hi\"}}\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if '{' != line[0] {
+		t.Fatalf("got leading byte %q (%q), want the reply to start with '{' - a handshake byte leaked into the default protocol", line[0], line)
+	}
+}
+
+func dialWithRetry(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			return conn
+		}
+		lastErr = err
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server on %s never came up: %v", addr, lastErr)
+	return nil
+}